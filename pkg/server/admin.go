@@ -0,0 +1,102 @@
+package server
+
+import (
+	"log"
+	"time"
+)
+
+// AdminConnection is the JSON representation of an active entry exposed by
+// the admin endpoints.
+type AdminConnection struct {
+	ClientIP    string    `json:"clientIP"`
+	StreamID    string    `json:"streamID"`
+	IsHLS       bool      `json:"isHLS"`
+	StartTime   time.Time `json:"startTime"`
+	LastSeen    time.Time `json:"lastSeen"`
+	AgeSeconds  float64   `json:"ageSeconds"`
+	IdleSeconds float64   `json:"idleSeconds"`
+}
+
+// ListConnections returns every active entry, for the admin endpoint to
+// render as JSON.
+func (cl *ConnectionLimiter) ListConnections() ([]AdminConnection, error) {
+	entries, err := cl.store.All()
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	conns := make([]AdminConnection, 0, len(entries))
+	for _, entry := range entries {
+		conns = append(conns, AdminConnection{
+			ClientIP:    entry.clientIP,
+			StreamID:    entry.streamID,
+			IsHLS:       entry.isHLS,
+			StartTime:   entry.startTime,
+			LastSeen:    entry.lastSeen,
+			AgeSeconds:  now.Sub(entry.startTime).Seconds(),
+			IdleSeconds: now.Sub(entry.lastSeen).Seconds(),
+		})
+	}
+	return conns, nil
+}
+
+// Kick forcibly releases clientIP:streamID, invoking any cancel func
+// registered via RegisterCancel so an in-flight upstream copy is torn down
+// rather than left to finish (or time out) on its own. It reports whether
+// an entry was found and released. Like Release, it removes the entry via
+// the store's atomic Pop rather than holding cl.mu across a separate
+// Get-then-Remove, so cl.mu (in-process bookkeeping only) is never held
+// across what may be a network round trip to the store.
+func (cl *ConnectionLimiter) Kick(clientIP, streamID string) bool {
+	key := connKey(clientIP, streamID)
+
+	entry, existed, err := cl.store.Pop(key)
+	if err != nil {
+		log.Printf("[iptv-proxy] Kick: store error for %s: %v", key, err)
+		return false
+	}
+	if !existed {
+		return false
+	}
+
+	cl.mu.Lock()
+	if ce, ok := cl.cancels[key]; ok && ce.startTime.Equal(entry.startTime) {
+		ce.cancel()
+		delete(cl.cancels, key)
+	}
+	cl.mu.Unlock()
+
+	if !entry.isHLS {
+		cl.longLivedReleased.Add(1)
+	}
+	active, _ := cl.store.Count()
+	log.Printf("[iptv-proxy] Connection kicked: %s (active: %d/%d)", key, active, cl.maxConnections)
+
+	cl.mu.Lock()
+	cl.wakeNextWaiterLocked()
+	cl.mu.Unlock()
+	return true
+}
+
+// KickIP forcibly releases every active entry belonging to clientIP, the
+// same way Kick does for a single entry. It returns the number of entries
+// released.
+func (cl *ConnectionLimiter) KickIP(clientIP string) int {
+	entries, err := cl.store.All()
+	if err != nil {
+		log.Printf("[iptv-proxy] KickIP: store error: %v", err)
+		return 0
+	}
+
+	n := 0
+	for _, entry := range entries {
+		if entry.clientIP != clientIP {
+			continue
+		}
+		if cl.Kick(entry.clientIP, entry.streamID) {
+			n++
+		}
+	}
+	return n
+}
@@ -0,0 +1,109 @@
+package server
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"log"
+	"net/http"
+)
+
+// AdminSecretHeader is the header admin endpoints require to carry the
+// shared secret configured via NewAdminHandler.
+const AdminSecretHeader = "X-Admin-Secret"
+
+// NewAdminHandler returns an http.Handler exposing cl's active connections
+// for inspection and forced release, protected by a shared secret passed in
+// the AdminSecretHeader header. This is deliberately simple bearer-token
+// auth rather than anything session-based, so it works the same whether the
+// proxy is reached directly or sits behind a reverse proxy that's already
+// handling its own authentication. An empty secret always rejects, so the
+// endpoint can't be left open by misconfiguration.
+//
+// Routes:
+//
+//	GET  /admin/connections      list active connections as JSON
+//	POST /admin/connections/kick release one {clientIP, streamID}
+//	POST /admin/connections/kick-ip release every connection for {clientIP}
+func NewAdminHandler(cl *ConnectionLimiter, secret string) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/admin/connections", handleListConnections(cl))
+	mux.HandleFunc("/admin/connections/kick", handleKick(cl))
+	mux.HandleFunc("/admin/connections/kick-ip", handleKickIP(cl))
+	return requireAdminSecret(secret, mux)
+}
+
+func handleListConnections(cl *ConnectionLimiter) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		conns, err := cl.ListConnections()
+		if err != nil {
+			http.Error(w, "internal error", http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, conns)
+	}
+}
+
+func handleKick(cl *ConnectionLimiter) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		var req struct {
+			ClientIP string `json:"clientIP"`
+			StreamID string `json:"streamID"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "invalid request body", http.StatusBadRequest)
+			return
+		}
+		if !cl.Kick(req.ClientIP, req.StreamID) {
+			http.Error(w, "connection not found", http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func handleKickIP(cl *ConnectionLimiter) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		var req struct {
+			ClientIP string `json:"clientIP"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "invalid request body", http.StatusBadRequest)
+			return
+		}
+		writeJSON(w, struct {
+			Kicked int `json:"kicked"`
+		}{Kicked: cl.KickIP(req.ClientIP)})
+	}
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Printf("[iptv-proxy] admin: encode response: %v", err)
+	}
+}
+
+// requireAdminSecret rejects any request whose AdminSecretHeader doesn't
+// match secret in constant time, so the comparison itself doesn't leak the
+// secret through timing.
+func requireAdminSecret(secret string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if secret == "" || subtle.ConstantTimeCompare([]byte(r.Header.Get(AdminSecretHeader)), []byte(secret)) != 1 {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -1,15 +1,74 @@
 package server
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"log"
 	"sync"
+	"sync/atomic"
 	"time"
+
+	"golang.org/x/time/rate"
 )
 
 const (
 	hlsStaleTimeout  = 30 * time.Second
 	hlsSweepInterval = 10 * time.Second
+
+	// defaultAcquireRate/defaultAcquireBurst are the per-IP acquire/touch attempt
+	// limits applied when WithAcquireRateLimit is not used.
+	defaultAcquireRate  = rate.Limit(1)
+	defaultAcquireBurst = 10
+
+	// defaultGlobalAcquireRate/defaultGlobalAcquireBurst are the proxy-wide
+	// acquire/touch attempt limits applied when WithGlobalAcquireRateLimit is
+	// not used. They're deliberately much larger than the per-IP defaults:
+	// the global bucket exists to protect the upstream provider from an
+	// unreasonable aggregate rate, not to bound any single IP.
+	defaultGlobalAcquireRate  = rate.Limit(50)
+	defaultGlobalAcquireBurst = 100
+
+	// rateLimiterPruneInterval is how often idle, full per-IP limiters are
+	// garbage collected so scan/scraping traffic from many distinct IPs
+	// doesn't grow the map without bound.
+	rateLimiterPruneInterval = time.Minute
+
+	// displacementInterval/displacementBurst bound how often SameIPOldest may
+	// evict on behalf of a single IP, guarding against two clients behind the
+	// same NAT ping-ponging each other off.
+	displacementInterval = 5 * time.Second
+	displacementBurst    = 2
+
+	// displacedBacklog bounds the Displaced() channel so a slow or absent
+	// consumer can't make eviction block the limiter.
+	displacedBacklog = 64
+
+	// waiterCapMultiple bounds the AcquireCtx/TouchCtx waiter queue at
+	// waiterCapMultiple * maxConnections, so a flood of callers parked on a
+	// full limiter can't accumulate unbounded goroutines.
+	waiterCapMultiple = 2
+)
+
+// ErrRateLimited is returned by Acquire/Touch when the caller (or the proxy
+// as a whole) is attempting connections faster than the configured rate
+// allows. Handlers should translate this into a 429 response, as opposed to
+// the 503 used for a plain capacity rejection.
+var ErrRateLimited = errors.New("connection attempt rate limited")
+
+// DisplacementPolicy selects whether (and how) a returning client may evict
+// one of its own existing entries instead of being rejected when the proxy
+// is at capacity.
+type DisplacementPolicy int
+
+const (
+	// NoDisplacement preserves the original behavior: at capacity, only the
+	// single-extra grace period in Store.Add applies.
+	NoDisplacement DisplacementPolicy = iota
+	// SameIPOldest lets an IP that already owns entries evict its own
+	// oldest one (by startTime, or lastSeen for HLS) to make room for a new
+	// acquire/touch, instead of being rejected outright.
+	SameIPOldest
 )
 
 type connEntry struct {
@@ -17,23 +76,167 @@ type connEntry struct {
 	lastSeen  time.Time
 	isHLS     bool
 	clientIP  string
+	streamID  string
+}
+
+// waiter is a caller parked in AcquireCtx/TouchCtx waiting for a slot to
+// free up. ch is buffered 1 so wakeNextWaiterLocked never blocks the holder
+// of cl.mu, even if the waiter has already given up via ctx.Done().
+type waiter struct {
+	ch chan struct{}
+}
+
+// ipLimiter is the per-client-IP token bucket used to rate-limit acquire/touch
+// attempts, along with enough bookkeeping to prune it once it's been idle at
+// full capacity for a while. fullSince is read and written only by
+// pruneRateLimiters, never by allowAttempt: Allow() always leaves tokens
+// below burst on success and near zero on failure, so "currently full" can
+// never be observed from inside the call that just consumed a token.
+type ipLimiter struct {
+	limiter   *rate.Limiter
+	fullSince time.Time // zero if not currently observed full
+}
+
+// cancelEntry pairs a registered cancel func with the startTime of the
+// connEntry it was registered for. Release, Kick, and tryDisplace all pop or
+// evict an entry from the store and then, separately, touch cl.cancels for
+// the same key — since those are two distinct steps, a concurrent
+// Acquire+RegisterCancel for the same (reused) key could otherwise land its
+// fresh cancel func in between, only for it to be wiped out by the stale
+// Release/Kick/tryDisplace call. Guarding every cancels mutation on startTime
+// matching the entry just popped/evicted closes that window: a cancelEntry
+// is only ever deleted (or invoked) if it still belongs to the entry that
+// triggered the deletion, not to whatever got re-registered after it.
+type cancelEntry struct {
+	startTime time.Time
+	cancel    context.CancelFunc
 }
 
 // ConnectionLimiter tracks active streams and enforces the provider's max connections limit.
 type ConnectionLimiter struct {
 	mu             sync.RWMutex
-	active         map[string]*connEntry // key: "clientIP:streamID"
-	maxConnections int                   // 0 = unlimited
+	store          Store // key: "clientIP:streamID"
+	maxConnections int   // 0 = unlimited
 	done           chan struct{}
+
+	acquireRate  rate.Limit
+	acquireBurst int
+
+	globalAcquireRate  rate.Limit
+	globalAcquireBurst int
+
+	ipLimitersMu sync.Mutex
+	ipLimiters   map[string]*ipLimiter
+	global       *rate.Limiter
+
+	displacementPolicy   DisplacementPolicy
+	displacementLimiters map[string]*rate.Limiter // per-IP, guarded by mu
+	cancels              map[string]cancelEntry
+	displaced            chan string
+	displacements        int
+	displacementsLimited int
+
+	// waiters is the FIFO queue of callers parked in AcquireCtx/TouchCtx,
+	// guarded by mu.
+	waiters []*waiter
+
+	// Counters. These are updated outside cl.mu in places (e.g. the rate
+	// limit rejection path), so they're atomics rather than plain ints.
+	connectionsAccepted      atomic.Int64
+	connectionsRejectedLimit atomic.Int64
+	connectionsRejectedRate  atomic.Int64
+	graceGrants              atomic.Int64
+	hlsAcquired              atomic.Int64
+	hlsExpiredBySweep        atomic.Int64
+	longLivedReleased        atomic.Int64
+}
+
+// Option configures optional ConnectionLimiter behavior at construction time.
+type Option func(*ConnectionLimiter)
+
+// WithAcquireRateLimit caps how often a single client IP may call
+// Acquire/Touch, using a token bucket with the given refill rate and burst
+// size. Use WithGlobalAcquireRateLimit to configure the separate,
+// proxy-wide bucket that protects the upstream provider even when clients
+// rotate IPs (NAT/CGN).
+func WithAcquireRateLimit(r rate.Limit, burst int) Option {
+	return func(cl *ConnectionLimiter) {
+		cl.acquireRate = r
+		cl.acquireBurst = burst
+	}
+}
+
+// WithGlobalAcquireRateLimit caps how often Acquire/Touch may be called
+// across all client IPs combined, using a token bucket with the given
+// refill rate and burst size. It's independent of WithAcquireRateLimit's
+// per-IP bucket; a deployment with a tight per-IP burst (to stop one
+// misbehaving client) shouldn't also starve every other IP's very next
+// attempt from a shared bucket sized for just one client.
+func WithGlobalAcquireRateLimit(r rate.Limit, burst int) Option {
+	return func(cl *ConnectionLimiter) {
+		cl.globalAcquireRate = r
+		cl.globalAcquireBurst = burst
+	}
+}
+
+// WithDisplacementPolicy opts the limiter into evicting a client's own
+// oldest entry at capacity rather than rejecting it outright. See
+// DisplacementPolicy for the available strategies.
+func WithDisplacementPolicy(policy DisplacementPolicy) Option {
+	return func(cl *ConnectionLimiter) {
+		cl.displacementPolicy = policy
+	}
+}
+
+// WithStore backs the limiter with a Store other than the default
+// process-local memStore, e.g. a redisStore shared across replicas so the
+// connection budget is enforced proxy-wide rather than per instance. A
+// Store that itself enforces a connection budget (redisStore does, via its
+// own maxConnections) should be constructed with the same limit passed to
+// NewConnectionLimiter. Note that SameIPOldest displacement and
+// RegisterCancel are memStore-only capabilities (see tryDisplace): with a
+// distributed Store, displacement is silently unavailable and at capacity the
+// limiter admits only what the Store's own Add admits (for redisStore, the
+// single-extra same-IP grace) and rejects the rest.
+func WithStore(store Store) Option {
+	return func(cl *ConnectionLimiter) {
+		cl.store = store
+	}
 }
 
 // NewConnectionLimiter creates a new limiter. If max is 0, no limit is enforced.
-func NewConnectionLimiter(max int) *ConnectionLimiter {
+func NewConnectionLimiter(max int, opts ...Option) *ConnectionLimiter {
 	cl := &ConnectionLimiter{
-		active:         make(map[string]*connEntry),
-		maxConnections: max,
-		done:           make(chan struct{}),
+		maxConnections:     max,
+		done:               make(chan struct{}),
+		acquireRate:        defaultAcquireRate,
+		acquireBurst:       defaultAcquireBurst,
+		globalAcquireRate:  defaultGlobalAcquireRate,
+		globalAcquireBurst: defaultGlobalAcquireBurst,
+		ipLimiters:         make(map[string]*ipLimiter),
+
+		displacementLimiters: make(map[string]*rate.Limiter),
+		cancels:              make(map[string]cancelEntry),
+		displaced:            make(chan string, displacedBacklog),
+	}
+	for _, opt := range opts {
+		opt(cl)
+	}
+	if cl.store == nil {
+		cl.store = newMemStore(max)
+	}
+	if cl.displacementPolicy == SameIPOldest {
+		// With a displacement policy configured, tryDisplace (not Add's own
+		// same-IP grace carve-out) is what decides whether a same-IP caller
+		// gets in at capacity — otherwise grace admits the entry first and
+		// tryDisplace never even runs. See store.go's graceDisabled.
+		if ms, ok := cl.store.(*memStore); ok {
+			ms.graceDisabled = true
+		}
 	}
+	cl.global = rate.NewLimiter(cl.globalAcquireRate, cl.globalAcquireBurst)
+
+	registerLimiterExpvar(cl)
 	go cl.sweepStaleHLS()
 	return cl
 }
@@ -49,132 +252,470 @@ func connKey(clientIP, streamID string) string {
 
 // Acquire reserves a connection slot for a long-lived stream.
 // Returns nil if the slot was acquired (or already held), or an error if the limit is reached.
+// It never blocks; it is equivalent to AcquireCtx with an already-cancelled context.
 func (cl *ConnectionLimiter) Acquire(clientIP, streamID string) error {
-	cl.mu.Lock()
-	defer cl.mu.Unlock()
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	return cl.AcquireCtx(ctx, clientIP, streamID)
+}
 
+// AcquireCtx reserves a connection slot for a long-lived stream, parking the
+// caller (FIFO, alongside any other waiters) if the limiter is at capacity
+// and no displacement applies. It returns nil once a slot is held, or
+// ctx.Err() if ctx is done before one frees up, or an error if the waiter
+// queue itself is full.
+func (cl *ConnectionLimiter) AcquireCtx(ctx context.Context, clientIP, streamID string) error {
+	if !cl.allowAttempt(clientIP) {
+		cl.connectionsRejectedRate.Add(1)
+		return ErrRateLimited
+	}
+	return cl.waitForSlot(ctx, clientIP, streamID, false)
+}
+
+// Release frees a connection slot for a long-lived stream and wakes the
+// longest-waiting AcquireCtx/TouchCtx caller, if any. It removes the entry
+// via the store's atomic Pop rather than a separate Get-then-Remove under
+// cl.mu, so two concurrent Release calls for the same key still can't both
+// observe it as present and double-count the release — without holding
+// cl.mu (which guards only in-process bookkeeping) across what may be a
+// network round trip to the store.
+func (cl *ConnectionLimiter) Release(clientIP, streamID string) {
 	key := connKey(clientIP, streamID)
 
-	// Already tracking this exact stream — no-op
-	if _, exists := cl.active[key]; exists {
-		return nil
+	entry, existed, err := cl.store.Pop(key)
+	if err != nil {
+		log.Printf("[iptv-proxy] Release: store error for %s: %v", key, err)
+		return
+	}
+	if !existed {
+		return
 	}
 
-	if err := cl.checkLimit(clientIP); err != nil {
-		return err
+	cl.mu.Lock()
+	if ce, ok := cl.cancels[key]; ok && ce.startTime.Equal(entry.startTime) {
+		delete(cl.cancels, key)
 	}
+	cl.mu.Unlock()
 
-	now := time.Now()
-	cl.active[key] = &connEntry{
-		startTime: now,
-		lastSeen:  now,
-		isHLS:     false,
-		clientIP:  clientIP,
+	if !entry.isHLS {
+		cl.longLivedReleased.Add(1)
 	}
-	log.Printf("[iptv-proxy] Connection acquired: %s (active: %d/%d)", key, len(cl.active), cl.maxConnections)
-	return nil
-}
+	active, _ := cl.store.Count()
+	log.Printf("[iptv-proxy] Connection released: %s (active: %d/%d)", key, active, cl.maxConnections)
 
-// Release frees a connection slot for a long-lived stream.
-func (cl *ConnectionLimiter) Release(clientIP, streamID string) {
 	cl.mu.Lock()
-	defer cl.mu.Unlock()
+	cl.wakeNextWaiterLocked()
+	cl.mu.Unlock()
+}
 
+// RegisterCancel associates a cancel function with an already-acquired entry
+// so that, if it is later evicted by a displacement policy, the caller's
+// in-flight upstream copy can be torn down rather than left to time out on
+// its own. It is a no-op if the entry is no longer active.
+func (cl *ConnectionLimiter) RegisterCancel(clientIP, streamID string, cancel context.CancelFunc) {
 	key := connKey(clientIP, streamID)
-	if _, exists := cl.active[key]; exists {
-		delete(cl.active, key)
-		log.Printf("[iptv-proxy] Connection released: %s (active: %d/%d)", key, len(cl.active), cl.maxConnections)
+
+	// Get runs without cl.mu held, same as waitForSlot/Release/Kick/tryDisplace,
+	// since for a Store like redisStore it's a network round trip. If the
+	// entry is gone by the time we take cl.mu below, the write leaves an
+	// orphaned cancelEntry that nothing will ever match by startTime again;
+	// pruneCancels reaps those periodically, the same way pruneRateLimiters
+	// bounds cl.ipLimiters.
+	entry, exists, err := cl.store.Get(key)
+	if err != nil || !exists {
+		return
 	}
+
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+	cl.cancels[key] = cancelEntry{startTime: entry.startTime, cancel: cancel}
+}
+
+// Displaced returns a channel on which the key ("clientIP:streamID") of
+// every entry evicted by a displacement policy is published. Handlers
+// holding a registered cancel func for that key don't strictly need to
+// select on this channel themselves, but it's useful for logging/metrics
+// and for callers that didn't register a cancel func.
+func (cl *ConnectionLimiter) Displaced() <-chan string {
+	return cl.displaced
 }
 
 // Touch registers or refreshes an HLS connection slot. HLS connections are cleaned up
 // by the background sweeper when they haven't been seen for hlsStaleTimeout.
+// It never blocks; it is equivalent to TouchCtx with an already-cancelled context.
 func (cl *ConnectionLimiter) Touch(clientIP, streamID string) error {
-	cl.mu.Lock()
-	defer cl.mu.Unlock()
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	return cl.TouchCtx(ctx, clientIP, streamID)
+}
 
+// TouchCtx registers or refreshes an HLS connection slot, parking the caller
+// (FIFO, alongside any other waiters) if the limiter is at capacity and no
+// displacement applies. It returns nil once a slot is held, or ctx.Err() if
+// ctx is done before one frees up, or an error if the waiter queue itself is
+// full.
+func (cl *ConnectionLimiter) TouchCtx(ctx context.Context, clientIP, streamID string) error {
+	if !cl.allowAttempt(clientIP) {
+		cl.connectionsRejectedRate.Add(1)
+		return ErrRateLimited
+	}
+	return cl.waitForSlot(ctx, clientIP, streamID, true)
+}
+
+// waitForSlot implements the shared admit-or-park logic behind
+// Acquire/AcquireCtx and Touch/TouchCtx. isHLS selects which kind of entry
+// is recorded once a slot is admitted. cl.mu is only taken around the
+// purely in-process waiter-queue bookkeeping, not around the store calls
+// themselves (which, for a Store like redisStore, are a network round
+// trip) — Store.Add's own atomicity is what makes the admit check safe
+// under concurrent callers, the same as it always was for memStore.
+func (cl *ConnectionLimiter) waitForSlot(ctx context.Context, clientIP, streamID string, isHLS bool) error {
 	key := connKey(clientIP, streamID)
 
-	// Already tracking — just refresh timestamp
-	if entry, exists := cl.active[key]; exists {
-		entry.lastSeen = time.Now()
-		return nil
+	for {
+		_, exists, err := cl.store.Get(key)
+		if err != nil {
+			return err
+		}
+		if exists {
+			if isHLS {
+				if err := cl.store.Refresh(key); err != nil {
+					log.Printf("[iptv-proxy] waitForSlot: store error refreshing %s: %v", key, err)
+				}
+			}
+			return nil
+		}
+
+		now := time.Now()
+		ok, active, err := cl.store.Add(key, &connEntry{startTime: now, lastSeen: now, isHLS: isHLS, clientIP: clientIP, streamID: streamID})
+		if err != nil {
+			return err
+		}
+		if !ok && cl.tryDisplace(clientIP) {
+			ok, active, err = cl.store.Add(key, &connEntry{startTime: now, lastSeen: now, isHLS: isHLS, clientIP: clientIP, streamID: streamID})
+			if err != nil {
+				return err
+			}
+		}
+		if ok {
+			grace := cl.maxConnections > 0 && active > cl.maxConnections
+			cl.admit(key, isHLS, grace, active)
+			return nil
+		}
+
+		limitErr := fmt.Errorf("max connections reached (%d/%d)", active, cl.maxConnections)
+
+		// A caller whose ctx is already done (including Acquire/Touch's
+		// always-cancelled ctx) gets the immediate rejection rather than
+		// cycling through the waiter queue just to be woken by ctx.Done().
+		select {
+		case <-ctx.Done():
+			cl.connectionsRejectedLimit.Add(1)
+			return limitErr
+		default:
+		}
+
+		cl.mu.Lock()
+		if len(cl.waiters) >= waiterCapMultiple*cl.maxConnections {
+			cl.mu.Unlock()
+			cl.connectionsRejectedLimit.Add(1)
+			return limitErr
+		}
+		w := &waiter{ch: make(chan struct{}, 1)}
+		cl.waiters = append(cl.waiters, w)
+		cl.mu.Unlock()
+
+		select {
+		case <-w.ch:
+			continue
+		case <-ctx.Done():
+			cl.mu.Lock()
+			if !cl.removeWaiterLocked(w) {
+				// w was already popped and granted a slot before we noticed
+				// ctx firing; don't let that grant go to waste.
+				cl.wakeNextWaiterLocked()
+			}
+			cl.mu.Unlock()
+			return ctx.Err()
+		}
 	}
+}
 
-	if err := cl.checkLimit(clientIP); err != nil {
-		return err
+// admit records the counters for a newly admitted entry (already inserted
+// into cl.store by the caller). It only touches atomic counters, so unlike
+// most of ConnectionLimiter's bookkeeping it doesn't need cl.mu.
+func (cl *ConnectionLimiter) admit(key string, isHLS, grace bool, active int) {
+	if grace {
+		cl.graceGrants.Add(1)
 	}
 
-	now := time.Now()
-	cl.active[key] = &connEntry{
-		startTime: now,
-		lastSeen:  now,
-		isHLS:     true,
-		clientIP:  clientIP,
+	cl.connectionsAccepted.Add(1)
+	if isHLS {
+		cl.hlsAcquired.Add(1)
+		log.Printf("[iptv-proxy] HLS connection acquired: %s (active: %d/%d)", key, active, cl.maxConnections)
+	} else {
+		log.Printf("[iptv-proxy] Connection acquired: %s (active: %d/%d)", key, active, cl.maxConnections)
 	}
-	log.Printf("[iptv-proxy] HLS connection acquired: %s (active: %d/%d)", key, len(cl.active), cl.maxConnections)
-	return nil
+}
+
+// wakeNextWaiterLocked wakes the longest-waiting AcquireCtx/TouchCtx caller,
+// if any, so it retries store.Add. Must be called with cl.mu held.
+func (cl *ConnectionLimiter) wakeNextWaiterLocked() {
+	if len(cl.waiters) == 0 {
+		return
+	}
+	w := cl.waiters[0]
+	cl.waiters = cl.waiters[1:]
+	select {
+	case w.ch <- struct{}{}:
+	default:
+	}
+}
+
+// removeWaiterLocked removes w from the waiter queue, reporting whether it
+// was still present (i.e. hadn't already been woken). Must be called with
+// cl.mu held.
+func (cl *ConnectionLimiter) removeWaiterLocked(w *waiter) bool {
+	for i, ww := range cl.waiters {
+		if ww == w {
+			cl.waiters = append(cl.waiters[:i], cl.waiters[i+1:]...)
+			return true
+		}
+	}
+	return false
 }
 
 // ActiveCount returns the number of currently active connections.
 func (cl *ConnectionLimiter) ActiveCount() int {
+	n, err := cl.store.Count()
+	if err != nil {
+		log.Printf("[iptv-proxy] ActiveCount: store error: %v", err)
+		return 0
+	}
+	return n
+}
+
+// Displacements returns the total number of entries evicted so far by the
+// SameIPOldest displacement policy.
+func (cl *ConnectionLimiter) Displacements() int {
+	cl.mu.RLock()
+	defer cl.mu.RUnlock()
+	return cl.displacements
+}
+
+// DisplacementsLimited returns the number of displacement attempts that were
+// denied by the per-IP displacement rate limiter.
+func (cl *ConnectionLimiter) DisplacementsLimited() int {
 	cl.mu.RLock()
 	defer cl.mu.RUnlock()
-	return len(cl.active)
+	return cl.displacementsLimited
 }
 
-// checkLimit checks whether a new connection from clientIP is allowed.
-// Must be called with cl.mu held.
-func (cl *ConnectionLimiter) checkLimit(clientIP string) error {
-	if cl.maxConnections <= 0 {
-		return nil
+// tryDisplace attempts to make room for clientIP by evicting its own oldest
+// entry, per the configured DisplacementPolicy. It reports whether an entry
+// was evicted (and thus whether the caller's retried store.Add may
+// succeed). It manages cl.mu itself, taking it only around the in-process
+// bookkeeping (cancels/counters/displacementLimiters) rather than across
+// ms.evictOldestForIP or the subsequent store.Count, so it composes with
+// waitForSlot no longer holding cl.mu across store calls.
+func (cl *ConnectionLimiter) tryDisplace(clientIP string) bool {
+	if cl.displacementPolicy != SameIPOldest {
+		return false
+	}
+	// SameIPOldest needs to pick and remove an IP's oldest entry in one
+	// step, which the generic Store interface has no operation for; it's only
+	// available when backed by the in-process memStore.
+	ms, ok := cl.store.(*memStore)
+	if !ok {
+		return false
 	}
 
-	if len(cl.active) < cl.maxConnections {
-		return nil
+	cl.mu.Lock()
+	allowed := cl.allowDisplacementLocked(clientIP)
+	if !allowed {
+		cl.displacementsLimited++
+	}
+	cl.mu.Unlock()
+	if !allowed {
+		return false
 	}
 
-	// Grace period: allow exactly one extra connection for an IP that already has
-	// an active stream. This handles channel switching where the old stream hasn't
-	// disconnected yet. The grace only applies if total active is exactly at the
-	// limit (not already over it from a previous grace).
-	if len(cl.active) == cl.maxConnections && cl.countIPStreams(clientIP) > 0 {
-		return nil
+	oldestKey, oldestEntry, found := ms.evictOldestForIP(clientIP)
+	if !found {
+		return false
 	}
 
-	return fmt.Errorf("max connections reached (%d/%d)", len(cl.active), cl.maxConnections)
+	cl.mu.Lock()
+	if ce, ok := cl.cancels[oldestKey]; ok && ce.startTime.Equal(oldestEntry.startTime) {
+		ce.cancel()
+		delete(cl.cancels, oldestKey)
+	}
+	cl.displacements++
+	cl.mu.Unlock()
+
+	active, _ := cl.store.Count()
+	log.Printf("[iptv-proxy] Connection displaced: %s (active: %d/%d)", oldestKey, active, cl.maxConnections)
+
+	select {
+	case cl.displaced <- oldestKey:
+	default:
+		log.Printf("[iptv-proxy] Displaced() channel full, dropping notification for %s", oldestKey)
+	}
+	return true
+}
+
+// allowDisplacementLocked rate-limits how often a single IP may trigger a
+// displacement, so two clients behind the same NAT can't ping-pong each
+// other off. Must be called with cl.mu held.
+func (cl *ConnectionLimiter) allowDisplacementLocked(clientIP string) bool {
+	limiter, exists := cl.displacementLimiters[clientIP]
+	if !exists {
+		limiter = rate.NewLimiter(rate.Every(displacementInterval), displacementBurst)
+		cl.displacementLimiters[clientIP] = limiter
+	}
+	return limiter.Allow()
 }
 
-// countIPStreams returns the number of active streams for the given IP.
-// Must be called with cl.mu held.
-func (cl *ConnectionLimiter) countIPStreams(clientIP string) int {
-	count := 0
-	for _, entry := range cl.active {
-		if entry.clientIP == clientIP {
-			count++
+// allowAttempt reports whether an acquire/touch attempt from clientIP should
+// proceed, consuming a token from both the global and per-IP buckets. It is
+// intentionally called before cl.mu is taken, so a client hammering the
+// limiter never contends the lock guarding active streams.
+func (cl *ConnectionLimiter) allowAttempt(clientIP string) bool {
+	if !cl.global.Allow() {
+		return false
+	}
+
+	cl.ipLimitersMu.Lock()
+	defer cl.ipLimitersMu.Unlock()
+
+	rl, exists := cl.ipLimiters[clientIP]
+	if !exists {
+		rl = &ipLimiter{limiter: rate.NewLimiter(cl.acquireRate, cl.acquireBurst)}
+		cl.ipLimiters[clientIP] = rl
+	}
+	return rl.limiter.Allow()
+}
+
+// pruneRateLimiters drops per-IP rate limiter entries that have been sitting
+// full (i.e. unused) for longer than rateLimiterPruneInterval, so IP churn
+// from scanning/scraping traffic doesn't grow the map forever. "Full" is
+// evaluated here via rate.Limiter.Tokens(), which doesn't consume a token,
+// rather than latched from allowAttempt's hot path.
+func (cl *ConnectionLimiter) pruneRateLimiters() {
+	cl.ipLimitersMu.Lock()
+	defer cl.ipLimitersMu.Unlock()
+
+	now := time.Now()
+	for ip, rl := range cl.ipLimiters {
+		if rl.limiter.Tokens() < float64(cl.acquireBurst) {
+			rl.fullSince = time.Time{}
+			continue
+		}
+		if rl.fullSince.IsZero() {
+			rl.fullSince = now
+			continue
+		}
+		if now.Sub(rl.fullSince) > rateLimiterPruneInterval {
+			delete(cl.ipLimiters, ip)
 		}
 	}
-	return count
+}
+
+// pruneCancels reaps cl.cancels entries whose key is no longer current in
+// the store: RegisterCancel's store.Get runs without cl.mu held, so if
+// Release/Kick/tryDisplace pops or evicts that same key in between the Get
+// and RegisterCancel's write, the resulting cancelEntry is orphaned — its
+// startTime will never again match what's popped/evicted for that key, so
+// nothing else will ever delete it. Runs on the same periodic tick as
+// pruneRateLimiters rather than re-verifying against the store from
+// RegisterCancel's hot path, which for redisStore would mean holding cl.mu
+// across a network round trip.
+func (cl *ConnectionLimiter) pruneCancels() {
+	cl.mu.Lock()
+	keys := make([]string, 0, len(cl.cancels))
+	for key := range cl.cancels {
+		keys = append(keys, key)
+	}
+	cl.mu.Unlock()
+
+	for _, key := range keys {
+		entry, exists, err := cl.store.Get(key)
+		if err != nil {
+			continue
+		}
+		cl.mu.Lock()
+		if ce, ok := cl.cancels[key]; ok && (!exists || !ce.startTime.Equal(entry.startTime)) {
+			delete(cl.cancels, key)
+		}
+		cl.mu.Unlock()
+	}
+}
+
+// sweepLocker is implemented by Store backends shared across replicas, so
+// only one instance actually runs the periodic HLS sweep at a time instead
+// of every replica racing to sweep the same shared state. memStore doesn't
+// implement it, since a process-local store has nothing to coordinate with.
+type sweepLocker interface {
+	TryLockSweep() (bool, error)
+	UnlockSweep()
 }
 
 func (cl *ConnectionLimiter) sweepStaleHLS() {
-	ticker := time.NewTicker(hlsSweepInterval)
-	defer ticker.Stop()
+	hlsTicker := time.NewTicker(hlsSweepInterval)
+	defer hlsTicker.Stop()
+
+	pruneTicker := time.NewTicker(rateLimiterPruneInterval)
+	defer pruneTicker.Stop()
+
+	locker, distributed := cl.store.(sweepLocker)
 
 	for {
 		select {
 		case <-cl.done:
 			return
-		case <-ticker.C:
+		case <-hlsTicker.C:
+			if distributed {
+				ok, err := locker.TryLockSweep()
+				if err != nil {
+					log.Printf("[iptv-proxy] HLS sweep: lock error: %v", err)
+					continue
+				}
+				if !ok {
+					continue
+				}
+			}
+
+			// SweepHLS and Count run without cl.mu held, same as
+			// waitForSlot/Release/Kick/tryDisplace, since for redisStore
+			// they're network round trips; cl.mu is only taken below, for
+			// the in-process cancels/waiter bookkeeping.
+			expired, err := cl.store.SweepHLS(time.Now().Add(-hlsStaleTimeout))
+			if err != nil {
+				log.Printf("[iptv-proxy] HLS sweep: store error: %v", err)
+				if distributed {
+					locker.UnlockSweep()
+				}
+				continue
+			}
+			active, _ := cl.store.Count()
 			cl.mu.Lock()
-			now := time.Now()
-			for key, entry := range cl.active {
-				if entry.isHLS && now.Sub(entry.lastSeen) > hlsStaleTimeout {
-					delete(cl.active, key)
-					log.Printf("[iptv-proxy] HLS connection expired: %s (active: %d/%d)", key, len(cl.active), cl.maxConnections)
+			for _, entry := range expired {
+				key := connKey(entry.clientIP, entry.streamID)
+				if ce, ok := cl.cancels[key]; ok && ce.startTime.Equal(entry.startTime) {
+					delete(cl.cancels, key)
 				}
+				cl.hlsExpiredBySweep.Add(1)
+				log.Printf("[iptv-proxy] HLS connection expired: %s (active: %d/%d)", key, active, cl.maxConnections)
+				cl.wakeNextWaiterLocked()
 			}
 			cl.mu.Unlock()
+
+			if distributed {
+				locker.UnlockSweep()
+			}
+		case <-pruneTicker.C:
+			cl.pruneRateLimiters()
+			cl.pruneCancels()
 		}
 	}
 }
@@ -1,9 +1,21 @@
 package server
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
 	"sync"
 	"testing"
 	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+	"golang.org/x/time/rate"
 )
 
 func TestNewConnectionLimiter(t *testing.T) {
@@ -152,7 +164,9 @@ func TestGracePeriodDifferentIPRejected(t *testing.T) {
 }
 
 func TestUnlimitedMode(t *testing.T) {
-	cl := NewConnectionLimiter(0)
+	// High burst so this test exercises the connection cap (none), not the
+	// acquire-rate limiter.
+	cl := NewConnectionLimiter(0, WithAcquireRateLimit(rate.Limit(1000), 1000))
 	defer cl.Stop()
 
 	// Should allow any number of connections
@@ -198,27 +212,38 @@ func TestTouchHLSMaxEnforced(t *testing.T) {
 	}
 }
 
+// ageEntry backdates key's lastSeen directly in the backing memStore, to
+// simulate a connection that's gone quiet without waiting out
+// hlsStaleTimeout for real.
+func ageEntry(t *testing.T, cl *ConnectionLimiter, clientIP, streamID string, age time.Duration) {
+	t.Helper()
+	ms, ok := cl.store.(*memStore)
+	if !ok {
+		t.Fatalf("ageEntry requires a memStore-backed limiter, got %T", cl.store)
+	}
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	entry, exists := ms.active[connKey(clientIP, streamID)]
+	if !exists {
+		t.Fatalf("no active entry for %s:%s", clientIP, streamID)
+	}
+	entry.lastSeen = time.Now().Add(-age)
+}
+
 func TestHLSSweepCleansStaleEntries(t *testing.T) {
 	cl := NewConnectionLimiter(2)
 	defer cl.Stop()
 
 	cl.Touch("10.0.0.1", "token-abc")
+	ageEntry(t, cl, "10.0.0.1", "token-abc", hlsStaleTimeout+time.Second)
 
-	// Manually age the entry
-	cl.mu.Lock()
-	key := connKey("10.0.0.1", "token-abc")
-	cl.active[key].lastSeen = time.Now().Add(-hlsStaleTimeout - time.Second)
-	cl.mu.Unlock()
-
-	// Run one sweep cycle manually
-	cl.mu.Lock()
-	now := time.Now()
-	for k, entry := range cl.active {
-		if entry.isHLS && now.Sub(entry.lastSeen) > hlsStaleTimeout {
-			delete(cl.active, k)
-		}
+	expired, err := cl.store.SweepHLS(time.Now().Add(-hlsStaleTimeout))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(expired) != 1 {
+		t.Errorf("expected 1 expired key, got %d", len(expired))
 	}
-	cl.mu.Unlock()
 
 	if cl.ActiveCount() != 0 {
 		t.Errorf("expected 0 active after sweep, got %d", cl.ActiveCount())
@@ -231,15 +256,10 @@ func TestHLSSweepKeepsFreshEntries(t *testing.T) {
 
 	cl.Touch("10.0.0.1", "token-abc")
 
-	// Run sweep — entry is fresh, should survive
-	cl.mu.Lock()
-	now := time.Now()
-	for k, entry := range cl.active {
-		if entry.isHLS && now.Sub(entry.lastSeen) > hlsStaleTimeout {
-			delete(cl.active, k)
-		}
+	// Sweep — entry is fresh, should survive
+	if _, err := cl.store.SweepHLS(time.Now().Add(-hlsStaleTimeout)); err != nil {
+		t.Fatalf("unexpected error: %v", err)
 	}
-	cl.mu.Unlock()
 
 	if cl.ActiveCount() != 1 {
 		t.Errorf("expected 1 active (fresh HLS should survive sweep), got %d", cl.ActiveCount())
@@ -253,19 +273,11 @@ func TestSweepDoesNotRemoveLongLived(t *testing.T) {
 	cl.Acquire("10.0.0.1", "100")
 
 	// Age the entry — but it's not HLS, so sweep should not remove it
-	cl.mu.Lock()
-	key := connKey("10.0.0.1", "100")
-	cl.active[key].lastSeen = time.Now().Add(-hlsStaleTimeout - time.Minute)
-	cl.mu.Unlock()
+	ageEntry(t, cl, "10.0.0.1", "100", hlsStaleTimeout+time.Minute)
 
-	cl.mu.Lock()
-	now := time.Now()
-	for k, entry := range cl.active {
-		if entry.isHLS && now.Sub(entry.lastSeen) > hlsStaleTimeout {
-			delete(cl.active, k)
-		}
+	if _, err := cl.store.SweepHLS(time.Now().Add(-hlsStaleTimeout)); err != nil {
+		t.Fatalf("unexpected error: %v", err)
 	}
-	cl.mu.Unlock()
 
 	if cl.ActiveCount() != 1 {
 		t.Errorf("expected 1 active (long-lived should survive sweep), got %d", cl.ActiveCount())
@@ -284,7 +296,9 @@ func TestReleaseNonexistentIsNoop(t *testing.T) {
 }
 
 func TestConcurrentAccess(t *testing.T) {
-	cl := NewConnectionLimiter(100)
+	// High burst so this test exercises locking/counting, not the
+	// acquire-rate limiter.
+	cl := NewConnectionLimiter(100, WithAcquireRateLimit(rate.Limit(1000), 1000))
 	defer cl.Stop()
 
 	var wg sync.WaitGroup
@@ -385,6 +399,368 @@ func TestMixedHLSAndLongLived(t *testing.T) {
 	}
 }
 
+func TestAcquireRateLimitPerIP(t *testing.T) {
+	cl := NewConnectionLimiter(100, WithAcquireRateLimit(rate.Limit(1), 2))
+	defer cl.Stop()
+
+	if err := cl.Acquire("10.0.0.1", "100"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := cl.Acquire("10.0.0.1", "101"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// Burst of 2 is exhausted — third immediate attempt should be rate limited.
+	err := cl.Acquire("10.0.0.1", "102")
+	if !errors.Is(err, ErrRateLimited) {
+		t.Fatalf("expected ErrRateLimited, got %v", err)
+	}
+	if cl.ActiveCount() != 2 {
+		t.Errorf("expected 2 active (rate limited attempt should not add), got %d", cl.ActiveCount())
+	}
+}
+
+func TestAcquireRateLimitIsPerIPNotGlobal(t *testing.T) {
+	cl := NewConnectionLimiter(100, WithAcquireRateLimit(rate.Limit(1), 1))
+	defer cl.Stop()
+
+	if err := cl.Acquire("10.0.0.1", "100"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// A different IP has its own bucket, so it should not be affected by
+	// 10.0.0.1 exhausting its burst.
+	if err := cl.Acquire("10.0.0.2", "200"); err != nil {
+		t.Fatalf("unexpected error for distinct IP: %v", err)
+	}
+}
+
+func TestGlobalRateLimitAppliesAcrossIPs(t *testing.T) {
+	cl := NewConnectionLimiter(100, WithGlobalAcquireRateLimit(rate.Limit(1), 2))
+	defer cl.Stop()
+
+	// Exhaust the global bucket (burst 2) using two different IPs so the
+	// per-IP buckets aren't the ones rejecting.
+	if err := cl.Acquire("10.0.0.1", "100"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := cl.Acquire("10.0.0.2", "200"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	err := cl.Acquire("10.0.0.3", "300")
+	if !errors.Is(err, ErrRateLimited) {
+		t.Fatalf("expected ErrRateLimited from exhausted global bucket, got %v", err)
+	}
+}
+
+func TestPerIPRateLimitDoesNotShrinkGlobalBucket(t *testing.T) {
+	// A tight per-IP burst (the documented use case: stop one misbehaving
+	// client) must not also shrink the global bucket down to that size —
+	// otherwise one IP's first attempt exhausts it and every other IP's
+	// very next attempt is wrongly rejected.
+	cl := NewConnectionLimiter(100, WithAcquireRateLimit(rate.Limit(1), 1))
+	defer cl.Stop()
+
+	for i, ip := range []string{"10.0.0.1", "10.0.0.2", "10.0.0.3"} {
+		if err := cl.Acquire(ip, "100"); err != nil {
+			t.Fatalf("unexpected error for IP #%d (%s): %v", i, ip, err)
+		}
+	}
+}
+
+func TestRateLimiterPruning(t *testing.T) {
+	// A fast rate means the bucket is back to full (tokens >= burst) almost
+	// immediately after the one Acquire below consumes a token, so
+	// pruneRateLimiters' real, non-destructive Tokens() check — not a value
+	// latched from allowAttempt's hot path — is what observes it as full.
+	cl := NewConnectionLimiter(100, WithAcquireRateLimit(rate.Limit(1000), 1))
+	defer cl.Stop()
+
+	if err := cl.Acquire("10.0.0.1", "100"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	cl.ipLimitersMu.Lock()
+	rl, exists := cl.ipLimiters["10.0.0.1"]
+	if !exists {
+		t.Fatal("expected a per-IP limiter to be tracked")
+	}
+	if !rl.fullSince.IsZero() {
+		t.Fatal("expected allowAttempt to never set fullSince itself")
+	}
+	cl.ipLimitersMu.Unlock()
+
+	time.Sleep(5 * time.Millisecond)
+	cl.pruneRateLimiters() // first call: observes the bucket full, latches fullSince
+
+	cl.ipLimitersMu.Lock()
+	if rl.fullSince.IsZero() {
+		cl.ipLimitersMu.Unlock()
+		t.Fatal("expected pruneRateLimiters to observe the refilled bucket as full")
+	}
+	// Force the entry to look like it's been full well past the prune window.
+	rl.fullSince = time.Now().Add(-rateLimiterPruneInterval - time.Second)
+	cl.ipLimitersMu.Unlock()
+
+	cl.pruneRateLimiters() // second call: still full, and now stale enough to prune
+
+	cl.ipLimitersMu.Lock()
+	_, exists = cl.ipLimiters["10.0.0.1"]
+	cl.ipLimitersMu.Unlock()
+	if exists {
+		t.Error("expected idle, full rate limiter entry to be pruned")
+	}
+}
+
+func TestPruneCancelsReapsOrphanedEntries(t *testing.T) {
+	cl := NewConnectionLimiter(2)
+	defer cl.Stop()
+
+	if err := cl.Acquire("10.0.0.1", "100"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	key := connKey("10.0.0.1", "100")
+
+	// Simulate the RegisterCancel-vs-Release race: a cancelEntry left behind
+	// whose startTime no longer matches (or whose key is no longer present
+	// in) the store, which nothing else will ever delete by startTime match.
+	cl.mu.Lock()
+	cl.cancels["orphan:gone"] = cancelEntry{startTime: time.Now(), cancel: func() {}}
+	cl.cancels[key] = cancelEntry{startTime: time.Now().Add(-time.Hour), cancel: func() {}}
+	cl.mu.Unlock()
+
+	cl.pruneCancels()
+
+	cl.mu.Lock()
+	_, orphanStillThere := cl.cancels["orphan:gone"]
+	_, staleStillThere := cl.cancels[key]
+	cl.mu.Unlock()
+	if orphanStillThere {
+		t.Error("expected cancelEntry for a key absent from the store to be reaped")
+	}
+	if staleStillThere {
+		t.Error("expected cancelEntry with a stale startTime to be reaped")
+	}
+}
+
+func TestDisplacementSameIPOldestEvictsOwnOldest(t *testing.T) {
+	cl := NewConnectionLimiter(2, WithDisplacementPolicy(SameIPOldest))
+	defer cl.Stop()
+
+	if err := cl.Acquire("10.0.0.1", "100"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := cl.Acquire("10.0.0.2", "200"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// 10.0.0.1 switches channels — at capacity, so its own oldest entry
+	// (100) should be displaced to make room for the new one.
+	if err := cl.Acquire("10.0.0.1", "101"); err != nil {
+		t.Fatalf("displacement should allow: %v", err)
+	}
+	if cl.ActiveCount() != 2 {
+		t.Errorf("expected 2 active after displacement, got %d", cl.ActiveCount())
+	}
+
+	select {
+	case key := <-cl.Displaced():
+		if key != connKey("10.0.0.1", "100") {
+			t.Errorf("expected displaced key %q, got %q", connKey("10.0.0.1", "100"), key)
+		}
+	default:
+		t.Fatal("expected a notification on Displaced()")
+	}
+
+	if cl.Displacements() != 1 {
+		t.Errorf("expected 1 displacement, got %d", cl.Displacements())
+	}
+}
+
+func TestDisplacementDoesNotEvictOtherIPs(t *testing.T) {
+	cl := NewConnectionLimiter(2, WithDisplacementPolicy(SameIPOldest))
+	defer cl.Stop()
+
+	cl.Acquire("10.0.0.1", "100")
+	cl.Acquire("10.0.0.2", "200")
+
+	// A brand-new IP owns nothing, so there's nothing of its own to
+	// displace — it should still be rejected rather than evicting a
+	// stranger's stream.
+	err := cl.Acquire("10.0.0.3", "300")
+	if err == nil {
+		t.Fatal("expected rejection: new IP has no entries of its own to displace")
+	}
+	if cl.ActiveCount() != 2 {
+		t.Errorf("expected 2 active, got %d", cl.ActiveCount())
+	}
+}
+
+func TestDisplacementRespectsRateLimit(t *testing.T) {
+	cl := NewConnectionLimiter(2, WithDisplacementPolicy(SameIPOldest))
+	defer cl.Stop()
+
+	cl.Acquire("10.0.0.1", "100")
+	cl.Acquire("10.0.0.2", "200")
+
+	// Burst of 2 displacements allowed back-to-back for the same IP.
+	if err := cl.Acquire("10.0.0.1", "101"); err != nil {
+		t.Fatalf("first displacement should allow: %v", err)
+	}
+	if err := cl.Acquire("10.0.0.1", "102"); err != nil {
+		t.Fatalf("second displacement (within burst) should allow: %v", err)
+	}
+
+	// Third displacement attempt in quick succession should be denied by
+	// the displacement rate limiter and fall back to rejection.
+	err := cl.Acquire("10.0.0.1", "103")
+	if err == nil {
+		t.Fatal("expected rejection once displacement burst is exhausted")
+	}
+	if cl.DisplacementsLimited() != 1 {
+		t.Errorf("expected 1 rate-limited displacement, got %d", cl.DisplacementsLimited())
+	}
+}
+
+func TestDisplacementOffByDefault(t *testing.T) {
+	cl := NewConnectionLimiter(2)
+	defer cl.Stop()
+
+	cl.Acquire("10.0.0.1", "100")
+	cl.Acquire("10.0.0.2", "200")
+
+	// Without WithDisplacementPolicy, channel switching still only gets the
+	// existing one-extra grace, not an eviction.
+	err := cl.Acquire("10.0.0.1", "101")
+	if err != nil {
+		t.Fatalf("expected grace to allow the extra stream: %v", err)
+	}
+	if cl.ActiveCount() != 3 {
+		t.Errorf("expected 3 active via grace (no displacement), got %d", cl.ActiveCount())
+	}
+}
+
+func TestRegisterCancelInvokedOnDisplacement(t *testing.T) {
+	cl := NewConnectionLimiter(2, WithDisplacementPolicy(SameIPOldest))
+	defer cl.Stop()
+
+	cl.Acquire("10.0.0.1", "100")
+	cl.Acquire("10.0.0.2", "200")
+
+	canceled := false
+	cl.RegisterCancel("10.0.0.1", "100", func() { canceled = true })
+
+	if err := cl.Acquire("10.0.0.1", "101"); err != nil {
+		t.Fatalf("displacement should allow: %v", err)
+	}
+	if !canceled {
+		t.Error("expected the registered cancel func to run when its entry was displaced")
+	}
+}
+
+func TestSnapshotTracksAcceptAndGauges(t *testing.T) {
+	cl := NewConnectionLimiter(2)
+	defer cl.Stop()
+
+	cl.Acquire("10.0.0.1", "100")
+	cl.Touch("10.0.0.2", "token-abc")
+
+	snap := cl.Snapshot()
+	if snap.ConnectionsAccepted != 2 {
+		t.Errorf("expected 2 accepted, got %d", snap.ConnectionsAccepted)
+	}
+	if snap.HLSAcquired != 1 {
+		t.Errorf("expected 1 HLS acquired, got %d", snap.HLSAcquired)
+	}
+	if snap.ActiveTotal != 2 || snap.ActiveHLS != 1 || snap.ActiveLongLived != 1 {
+		t.Errorf("unexpected gauges: %+v", snap)
+	}
+	if snap.UniqueClientIPs != 2 {
+		t.Errorf("expected 2 unique client IPs, got %d", snap.UniqueClientIPs)
+	}
+}
+
+func TestSnapshotTracksRejectLimit(t *testing.T) {
+	cl := NewConnectionLimiter(1)
+	defer cl.Stop()
+
+	cl.Acquire("10.0.0.1", "100")
+	cl.Acquire("10.0.0.2", "200") // new IP at capacity — rejected
+
+	snap := cl.Snapshot()
+	if snap.ConnectionsRejectedLimit != 1 {
+		t.Errorf("expected 1 rejected-by-limit, got %d", snap.ConnectionsRejectedLimit)
+	}
+}
+
+func TestSnapshotTracksRejectRate(t *testing.T) {
+	cl := NewConnectionLimiter(100, WithAcquireRateLimit(rate.Limit(1), 1))
+	defer cl.Stop()
+
+	cl.Acquire("10.0.0.1", "100")
+	cl.Acquire("10.0.0.1", "101") // burst exhausted — rate limited
+
+	snap := cl.Snapshot()
+	if snap.ConnectionsRejectedRate != 1 {
+		t.Errorf("expected 1 rejected-by-rate, got %d", snap.ConnectionsRejectedRate)
+	}
+}
+
+func TestSnapshotTracksGraceGrants(t *testing.T) {
+	cl := NewConnectionLimiter(2)
+	defer cl.Stop()
+
+	cl.Acquire("10.0.0.1", "100")
+	cl.Acquire("10.0.0.2", "200")
+	cl.Acquire("10.0.0.1", "101") // grace
+
+	snap := cl.Snapshot()
+	if snap.GraceGrants != 1 {
+		t.Errorf("expected 1 grace grant, got %d", snap.GraceGrants)
+	}
+}
+
+func TestSnapshotTracksSweepEviction(t *testing.T) {
+	cl := NewConnectionLimiter(2)
+	defer cl.Stop()
+
+	cl.Touch("10.0.0.1", "token-abc")
+	ageEntry(t, cl, "10.0.0.1", "token-abc", hlsStaleTimeout+time.Second)
+
+	expired, err := cl.store.SweepHLS(time.Now().Add(-hlsStaleTimeout))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	cl.mu.Lock()
+	for _, entry := range expired {
+		delete(cl.cancels, connKey(entry.clientIP, entry.streamID))
+		cl.hlsExpiredBySweep.Add(1)
+	}
+	cl.mu.Unlock()
+
+	snap := cl.Snapshot()
+	if snap.HLSExpiredBySweep != 1 {
+		t.Errorf("expected 1 swept HLS entry, got %d", snap.HLSExpiredBySweep)
+	}
+	if snap.ActiveTotal != 0 {
+		t.Errorf("expected 0 active after sweep, got %d", snap.ActiveTotal)
+	}
+}
+
+func TestSnapshotTracksLongLivedReleased(t *testing.T) {
+	cl := NewConnectionLimiter(2)
+	defer cl.Stop()
+
+	cl.Acquire("10.0.0.1", "100")
+	cl.Release("10.0.0.1", "100")
+
+	snap := cl.Snapshot()
+	if snap.LongLivedReleased != 1 {
+		t.Errorf("expected 1 long-lived released, got %d", snap.LongLivedReleased)
+	}
+}
+
 func TestConnKey(t *testing.T) {
 	key := connKey("10.0.0.1", "stream-42")
 	expected := "10.0.0.1:stream-42"
@@ -392,3 +768,601 @@ func TestConnKey(t *testing.T) {
 		t.Errorf("expected %q, got %q", expected, key)
 	}
 }
+
+func TestAcquireCtxUnblocksOnRelease(t *testing.T) {
+	cl := NewConnectionLimiter(1)
+	defer cl.Stop()
+
+	if err := cl.Acquire("10.0.0.1", "100"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- cl.AcquireCtx(context.Background(), "10.0.0.2", "200")
+	}()
+
+	// Give the goroutine a chance to park before freeing the slot.
+	time.Sleep(50 * time.Millisecond)
+	select {
+	case err := <-done:
+		t.Fatalf("expected AcquireCtx to block, but it returned: %v", err)
+	default:
+	}
+
+	cl.Release("10.0.0.1", "100")
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("expected waiter to acquire after release, got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for AcquireCtx to unblock")
+	}
+}
+
+func TestAcquireCtxDeadlineFiresBeforeRelease(t *testing.T) {
+	cl := NewConnectionLimiter(1)
+	defer cl.Stop()
+
+	if err := cl.Acquire("10.0.0.1", "100"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	err := cl.AcquireCtx(ctx, "10.0.0.2", "200")
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected context.DeadlineExceeded, got %v", err)
+	}
+
+	// The waiter must have unregistered itself, not just returned an error.
+	cl.mu.Lock()
+	waiting := len(cl.waiters)
+	cl.mu.Unlock()
+	if waiting != 0 {
+		t.Errorf("expected 0 queued waiters after deadline, got %d", waiting)
+	}
+}
+
+func TestAcquireCtxFIFOOrdering(t *testing.T) {
+	// maxConnections=2 gives a waiter cap of 2*2=4, enough room for all 3
+	// waiters below to queue at once.
+	cl := NewConnectionLimiter(2)
+	defer cl.Stop()
+
+	if err := cl.Acquire("10.0.0.1", "100"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := cl.Acquire("10.0.0.11", "110"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	const numWaiters = 3
+	order := make(chan int, numWaiters)
+	for i := 0; i < numWaiters; i++ {
+		i := i
+		go func() {
+			if err := cl.AcquireCtx(context.Background(), "10.0.0.2", "stream-"+string(rune('a'+i))); err != nil {
+				t.Errorf("waiter %d: unexpected error: %v", i, err)
+				order <- -1
+				return
+			}
+			order <- i
+		}()
+		// Give each goroutine time to enqueue before starting the next, so
+		// the queue order is deterministic.
+		for {
+			cl.mu.Lock()
+			n := len(cl.waiters)
+			cl.mu.Unlock()
+			if n == i+1 {
+				break
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+
+	// Release one slot at a time; each release should wake the oldest
+	// waiter first, and the loop releases each waiter's slot as soon as it
+	// acquires so the next can proceed.
+	cl.Release("10.0.0.1", "100")
+	for i := 0; i < numWaiters; i++ {
+		select {
+		case got := <-order:
+			if got != i {
+				t.Errorf("expected waiter %d to acquire next, got %d", i, got)
+			}
+			cl.Release("10.0.0.2", "stream-"+string(rune('a'+got)))
+		case <-time.After(time.Second):
+			t.Fatalf("timed out waiting for waiter %d", i)
+		}
+	}
+}
+
+func TestAcquireCtxQueueFullRejected(t *testing.T) {
+	cl := NewConnectionLimiter(1)
+	defer cl.Stop()
+
+	if err := cl.Acquire("10.0.0.1", "100"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// waiterCapMultiple * maxConnections == 2, so two waiters fill the queue.
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	for i := 0; i < 2; i++ {
+		go cl.AcquireCtx(ctx, "10.0.0.2", "queued-"+string(rune('a'+i)))
+	}
+	for {
+		cl.mu.Lock()
+		n := len(cl.waiters)
+		cl.mu.Unlock()
+		if n == 2 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	err := cl.AcquireCtx(context.Background(), "10.0.0.3", "300")
+	if err == nil {
+		t.Fatal("expected error when the waiter queue is full")
+	}
+}
+
+func TestMemStoreAddEnforcesCapacity(t *testing.T) {
+	s := newMemStore(1)
+
+	ok, active, err := s.Add("10.0.0.1:100", &connEntry{clientIP: "10.0.0.1"})
+	if err != nil || !ok || active != 1 {
+		t.Fatalf("expected first Add to succeed with active=1, got ok=%v active=%d err=%v", ok, active, err)
+	}
+
+	ok, active, err = s.Add("10.0.0.2:200", &connEntry{clientIP: "10.0.0.2"})
+	if err != nil || ok {
+		t.Fatalf("expected second Add to be rejected at capacity, got ok=%v active=%d err=%v", ok, active, err)
+	}
+}
+
+func TestMemStoreAddGrantsSameIPGrace(t *testing.T) {
+	s := newMemStore(1)
+
+	if ok, _, err := s.Add("10.0.0.1:100", &connEntry{clientIP: "10.0.0.1"}); err != nil || !ok {
+		t.Fatalf("expected first Add to succeed: ok=%v err=%v", ok, err)
+	}
+
+	ok, active, err := s.Add("10.0.0.1:101", &connEntry{clientIP: "10.0.0.1"})
+	if err != nil || !ok || active != 2 {
+		t.Fatalf("expected grace Add to succeed with active=2, got ok=%v active=%d err=%v", ok, active, err)
+	}
+}
+
+func TestMemStoreRefreshAndRemove(t *testing.T) {
+	s := newMemStore(0)
+	key := "10.0.0.1:100"
+	if _, _, err := s.Add(key, &connEntry{clientIP: "10.0.0.1", lastSeen: time.Unix(0, 0)}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if err := s.Refresh(key); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	entry, exists, err := s.Get(key)
+	if err != nil || !exists {
+		t.Fatalf("expected entry to still exist: exists=%v err=%v", exists, err)
+	}
+	if entry.lastSeen.Before(time.Now().Add(-time.Second)) {
+		t.Error("expected Refresh to update lastSeen")
+	}
+
+	if err := s.Remove(key); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, exists, _ := s.Get(key); exists {
+		t.Error("expected entry to be removed")
+	}
+}
+
+func TestMemStoreSweepHLSOnlyRemovesStaleHLS(t *testing.T) {
+	s := newMemStore(0)
+	now := time.Now()
+	if _, _, err := s.Add("10.0.0.1:token-stale", &connEntry{clientIP: "10.0.0.1", isHLS: true, lastSeen: now.Add(-time.Minute)}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, _, err := s.Add("10.0.0.2:token-fresh", &connEntry{clientIP: "10.0.0.2", isHLS: true, lastSeen: now}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, _, err := s.Add("10.0.0.3:300", &connEntry{clientIP: "10.0.0.3", isHLS: false, lastSeen: now.Add(-time.Minute)}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	expired, err := s.SweepHLS(now.Add(-hlsStaleTimeout))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(expired) != 1 || expired[0].clientIP != "10.0.0.1" {
+		t.Errorf("expected only the stale HLS entry to be swept, got %v", expired)
+	}
+	if count, _ := s.Count(); count != 2 {
+		t.Errorf("expected 2 entries remaining, got %d", count)
+	}
+}
+
+func TestWithStoreUsesProvidedBackend(t *testing.T) {
+	s := newMemStore(5)
+	cl := NewConnectionLimiter(2, WithStore(s))
+	defer cl.Stop()
+
+	if cl.store != Store(s) {
+		t.Fatal("expected NewConnectionLimiter to use the store passed via WithStore")
+	}
+
+	if err := cl.Acquire("10.0.0.1", "100"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if n, err := s.Count(); err != nil || n != 1 {
+		t.Errorf("expected the provided store to observe the acquire, got n=%d err=%v", n, err)
+	}
+}
+
+// newMiniredisStore starts an in-process miniredis server and returns a
+// redisStore backed by it, for exercising the Lua-scripted admit/pop paths
+// and the sweep lock without a real Redis instance.
+func newMiniredisStore(t *testing.T, maxConnections int) *redisStore {
+	t.Helper()
+
+	mr, err := miniredis.Run()
+	if err != nil {
+		t.Fatalf("failed to start miniredis: %v", err)
+	}
+	t.Cleanup(mr.Close)
+
+	client := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	t.Cleanup(func() { client.Close() })
+
+	return NewRedisStore(client, "test", maxConnections).(*redisStore)
+}
+
+func TestRedisStoreAddEnforcesCapacityAndGrace(t *testing.T) {
+	s := newMiniredisStore(t, 1)
+
+	ok, active, err := s.Add("10.0.0.1:100", &connEntry{clientIP: "10.0.0.1", lastSeen: time.Now()})
+	if err != nil || !ok || active != 1 {
+		t.Fatalf("expected first Add to succeed with active=1, got ok=%v active=%d err=%v", ok, active, err)
+	}
+
+	ok, active, err = s.Add("10.0.0.2:200", &connEntry{clientIP: "10.0.0.2", lastSeen: time.Now()})
+	if err != nil || ok {
+		t.Fatalf("expected second Add to be rejected at capacity, got ok=%v active=%d err=%v", ok, active, err)
+	}
+
+	ok, active, err = s.Add("10.0.0.1:101", &connEntry{clientIP: "10.0.0.1", lastSeen: time.Now()})
+	if err != nil || !ok || active != 2 {
+		t.Fatalf("expected grace Add to succeed with active=2, got ok=%v active=%d err=%v", ok, active, err)
+	}
+}
+
+func TestRedisStoreAddConcurrentCallersAdmitOnlyOne(t *testing.T) {
+	s := newMiniredisStore(t, 1)
+
+	const callers = 5
+	admitted := make([]bool, callers)
+	var wg sync.WaitGroup
+	for i := 0; i < callers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			ip := fmt.Sprintf("10.0.0.%d", i)
+			ok, _, err := s.Add(ip+":100", &connEntry{clientIP: ip, lastSeen: time.Now()})
+			if err != nil {
+				t.Errorf("unexpected error: %v", err)
+				return
+			}
+			admitted[i] = ok
+		}(i)
+	}
+	wg.Wait()
+
+	count := 0
+	for _, ok := range admitted {
+		if ok {
+			count++
+		}
+	}
+	if count != 1 {
+		t.Errorf("expected exactly 1 of %d concurrent Adds to be admitted at capacity 1, got %d", callers, count)
+	}
+}
+
+func TestRedisStorePopRemovesAndReturnsEntry(t *testing.T) {
+	s := newMiniredisStore(t, 0)
+	key := "10.0.0.1:100"
+	if _, _, err := s.Add(key, &connEntry{clientIP: "10.0.0.1", streamID: "100", lastSeen: time.Now()}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	entry, existed, err := s.Pop(key)
+	if err != nil || !existed {
+		t.Fatalf("expected entry to be popped: existed=%v err=%v", existed, err)
+	}
+	if entry.clientIP != "10.0.0.1" {
+		t.Errorf("expected popped entry's clientIP to be preserved, got %q", entry.clientIP)
+	}
+	if _, exists, _ := s.Get(key); exists {
+		t.Error("expected entry to be removed after Pop")
+	}
+
+	if _, existed, err := s.Pop(key); err != nil || existed {
+		t.Fatalf("expected second Pop to report not-existed, got existed=%v err=%v", existed, err)
+	}
+}
+
+func TestRedisStoreSweepHLSOnlyRemovesStaleHLS(t *testing.T) {
+	s := newMiniredisStore(t, 0)
+	now := time.Now()
+	if _, _, err := s.Add("10.0.0.1:token-stale", &connEntry{clientIP: "10.0.0.1", isHLS: true, lastSeen: now.Add(-time.Minute)}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, _, err := s.Add("10.0.0.2:token-fresh", &connEntry{clientIP: "10.0.0.2", isHLS: true, lastSeen: now}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, _, err := s.Add("10.0.0.3:300", &connEntry{clientIP: "10.0.0.3", isHLS: false, lastSeen: now.Add(-time.Minute)}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	expired, err := s.SweepHLS(now.Add(-hlsStaleTimeout))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(expired) != 1 || expired[0].clientIP != "10.0.0.1" {
+		t.Errorf("expected only the stale HLS entry to be swept, got %v", expired)
+	}
+	if count, _ := s.Count(); count != 2 {
+		t.Errorf("expected 2 entries remaining, got %d", count)
+	}
+}
+
+func TestRedisStoreSweepLockIsExclusive(t *testing.T) {
+	s := newMiniredisStore(t, 0)
+
+	ok, err := s.TryLockSweep()
+	if err != nil || !ok {
+		t.Fatalf("expected first TryLockSweep to succeed: ok=%v err=%v", ok, err)
+	}
+
+	ok, err = s.TryLockSweep()
+	if err != nil || ok {
+		t.Fatalf("expected second TryLockSweep to be denied while held: ok=%v err=%v", ok, err)
+	}
+
+	s.UnlockSweep()
+
+	ok, err = s.TryLockSweep()
+	if err != nil || !ok {
+		t.Fatalf("expected TryLockSweep to succeed again after UnlockSweep: ok=%v err=%v", ok, err)
+	}
+}
+
+func TestListConnectionsReportsAgeAndIdle(t *testing.T) {
+	cl := NewConnectionLimiter(0)
+	defer cl.Stop()
+
+	if err := cl.Acquire("10.0.0.1", "100"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := cl.Touch("10.0.0.2", "token-abc"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	conns, err := cl.ListConnections()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(conns) != 2 {
+		t.Fatalf("expected 2 connections, got %d", len(conns))
+	}
+	for _, c := range conns {
+		if c.StreamID == "" {
+			t.Errorf("expected a non-empty streamID for clientIP %s", c.ClientIP)
+		}
+		if c.AgeSeconds < 0 || c.IdleSeconds < 0 {
+			t.Errorf("expected non-negative age/idle, got age=%v idle=%v", c.AgeSeconds, c.IdleSeconds)
+		}
+	}
+}
+
+func TestKickReleasesEntryAndInvokesCancel(t *testing.T) {
+	cl := NewConnectionLimiter(0)
+	defer cl.Stop()
+
+	if err := cl.Acquire("10.0.0.1", "100"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cl.RegisterCancel("10.0.0.1", "100", cancel)
+
+	done := make(chan struct{})
+	go func() {
+		<-ctx.Done()
+		close(done)
+	}()
+
+	if !cl.Kick("10.0.0.1", "100") {
+		t.Fatal("expected Kick to find and release the entry")
+	}
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for the registered cancel func to fire")
+	}
+
+	if cl.ActiveCount() != 0 {
+		t.Errorf("expected 0 active after kick, got %d", cl.ActiveCount())
+	}
+	if cl.Kick("10.0.0.1", "100") {
+		t.Error("expected a second Kick of the same entry to report not found")
+	}
+}
+
+// TestKickTerminatesInFlightUpstreamCopy simulates the shape described by
+// the displacement/admin-kick feature: a handler goroutine parked in
+// io.Copy reading a never-ending upstream response, torn down by the
+// cancel func a caller registered at acquire time.
+func TestKickTerminatesInFlightUpstreamCopy(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		flusher := w.(http.Flusher)
+		for {
+			select {
+			case <-r.Context().Done():
+				return
+			default:
+				w.Write([]byte("x"))
+				flusher.Flush()
+				time.Sleep(time.Millisecond)
+			}
+		}
+	}))
+	defer upstream.Close()
+
+	cl := NewConnectionLimiter(0)
+	defer cl.Stop()
+
+	if err := cl.Acquire("10.0.0.1", "100"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, upstream.URL, nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer resp.Body.Close()
+	cl.RegisterCancel("10.0.0.1", "100", cancel)
+
+	copyDone := make(chan struct{})
+	go func() {
+		io.Copy(io.Discard, resp.Body)
+		close(copyDone)
+	}()
+
+	if !cl.Kick("10.0.0.1", "100") {
+		t.Fatal("expected Kick to find and release the entry")
+	}
+
+	select {
+	case <-copyDone:
+	case <-time.After(2 * time.Second):
+		t.Fatal("timed out waiting for the io.Copy goroutine to exit after kick")
+	}
+}
+
+func TestKickIPReleasesAllEntriesForIP(t *testing.T) {
+	cl := NewConnectionLimiter(0)
+	defer cl.Stop()
+
+	if err := cl.Acquire("10.0.0.1", "100"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := cl.Acquire("10.0.0.1", "101"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := cl.Acquire("10.0.0.2", "200"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if n := cl.KickIP("10.0.0.1"); n != 2 {
+		t.Errorf("expected 2 entries kicked, got %d", n)
+	}
+	if cl.ActiveCount() != 1 {
+		t.Errorf("expected 1 entry remaining, got %d", cl.ActiveCount())
+	}
+}
+
+func TestAdminHandlerRequiresSecret(t *testing.T) {
+	cl := NewConnectionLimiter(0)
+	defer cl.Stop()
+	handler := NewAdminHandler(cl, "s3cret")
+
+	req := httptest.NewRequest(http.MethodGet, "/admin/connections", nil)
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	if rec.Code != http.StatusUnauthorized {
+		t.Errorf("expected 401 without a secret header, got %d", rec.Code)
+	}
+
+	req.Header.Set(AdminSecretHeader, "wrong")
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	if rec.Code != http.StatusUnauthorized {
+		t.Errorf("expected 401 with a wrong secret, got %d", rec.Code)
+	}
+}
+
+func TestAdminHandlerRejectsEmptyConfiguredSecret(t *testing.T) {
+	cl := NewConnectionLimiter(0)
+	defer cl.Stop()
+	handler := NewAdminHandler(cl, "")
+
+	req := httptest.NewRequest(http.MethodGet, "/admin/connections", nil)
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	if rec.Code != http.StatusUnauthorized {
+		t.Errorf("expected 401 when no secret is configured, got %d", rec.Code)
+	}
+}
+
+func TestAdminHandlerListAndKick(t *testing.T) {
+	cl := NewConnectionLimiter(0)
+	defer cl.Stop()
+	if err := cl.Acquire("10.0.0.1", "100"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	handler := NewAdminHandler(cl, "s3cret")
+
+	listReq := httptest.NewRequest(http.MethodGet, "/admin/connections", nil)
+	listReq.Header.Set(AdminSecretHeader, "s3cret")
+	listRec := httptest.NewRecorder()
+	handler.ServeHTTP(listRec, listReq)
+	if listRec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", listRec.Code, listRec.Body.String())
+	}
+	var conns []AdminConnection
+	if err := json.Unmarshal(listRec.Body.Bytes(), &conns); err != nil {
+		t.Fatalf("unexpected error unmarshaling response: %v", err)
+	}
+	if len(conns) != 1 || conns[0].ClientIP != "10.0.0.1" || conns[0].StreamID != "100" {
+		t.Fatalf("unexpected connections list: %+v", conns)
+	}
+
+	kickBody, _ := json.Marshal(struct {
+		ClientIP string `json:"clientIP"`
+		StreamID string `json:"streamID"`
+	}{ClientIP: "10.0.0.1", StreamID: "100"})
+	kickReq := httptest.NewRequest(http.MethodPost, "/admin/connections/kick", bytes.NewReader(kickBody))
+	kickReq.Header.Set(AdminSecretHeader, "s3cret")
+	kickRec := httptest.NewRecorder()
+	handler.ServeHTTP(kickRec, kickReq)
+	if kickRec.Code != http.StatusNoContent {
+		t.Fatalf("expected 204, got %d: %s", kickRec.Code, kickRec.Body.String())
+	}
+
+	if cl.ActiveCount() != 0 {
+		t.Errorf("expected 0 active after admin kick, got %d", cl.ActiveCount())
+	}
+
+	missingReq := httptest.NewRequest(http.MethodPost, "/admin/connections/kick", bytes.NewReader(kickBody))
+	missingReq.Header.Set(AdminSecretHeader, "s3cret")
+	missingRec := httptest.NewRecorder()
+	handler.ServeHTTP(missingRec, missingReq)
+	if missingRec.Code != http.StatusNotFound {
+		t.Errorf("expected 404 kicking an already-released entry, got %d", missingRec.Code)
+	}
+}
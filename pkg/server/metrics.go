@@ -0,0 +1,110 @@
+package server
+
+import (
+	"expvar"
+	"log"
+	"sync"
+)
+
+// LimiterSnapshot is a point-in-time view of a ConnectionLimiter's counters
+// and gauges. The counters are atomics and the gauges come from a single
+// Store.All() call, so with a distributed Store a snapshot can be a moment
+// behind entries another replica just admitted or released; that's fine for
+// metrics/admin display but callers needing a strict invariant shouldn't
+// rely on cross-field consistency.
+type LimiterSnapshot struct {
+	ConnectionsAccepted      int64
+	ConnectionsRejectedLimit int64
+	ConnectionsRejectedRate  int64
+	GraceGrants              int64
+	HLSAcquired              int64
+	HLSExpiredBySweep        int64
+	LongLivedReleased        int64
+
+	ActiveTotal     int
+	ActiveHLS       int
+	ActiveLongLived int
+	UniqueClientIPs int
+}
+
+// Snapshot returns a view of cl's counters and gauges.
+func (cl *ConnectionLimiter) Snapshot() LimiterSnapshot {
+	entries, err := cl.store.All()
+	if err != nil {
+		log.Printf("[iptv-proxy] Snapshot: store error: %v", err)
+	}
+
+	var hls, longLived int
+	ips := make(map[string]struct{}, len(entries))
+	for _, entry := range entries {
+		if entry.isHLS {
+			hls++
+		} else {
+			longLived++
+		}
+		ips[entry.clientIP] = struct{}{}
+	}
+
+	return LimiterSnapshot{
+		ConnectionsAccepted:      cl.connectionsAccepted.Load(),
+		ConnectionsRejectedLimit: cl.connectionsRejectedLimit.Load(),
+		ConnectionsRejectedRate:  cl.connectionsRejectedRate.Load(),
+		GraceGrants:              cl.graceGrants.Load(),
+		HLSAcquired:              cl.hlsAcquired.Load(),
+		HLSExpiredBySweep:        cl.hlsExpiredBySweep.Load(),
+		LongLivedReleased:        cl.longLivedReleased.Load(),
+		ActiveTotal:              len(entries),
+		ActiveHLS:                hls,
+		ActiveLongLived:          longLived,
+		UniqueClientIPs:          len(ips),
+	}
+}
+
+// limiterExpvarOnce guards registration of the "iptv_proxy.limiter" expvar
+// map, which is process-global by nature (expvar.Publish panics on a
+// duplicate name). Deployments run a single ConnectionLimiter per process,
+// so binding the map's Funcs to the most recently constructed instance is
+// the right behavior in practice; tests that construct many limiters should
+// read Snapshot() directly rather than relying on expvar.
+var (
+	limiterExpvarOnce sync.Once
+	limiterExpvarMu   sync.Mutex
+	limiterExpvarCL   *ConnectionLimiter
+)
+
+func registerLimiterExpvar(cl *ConnectionLimiter) {
+	limiterExpvarMu.Lock()
+	limiterExpvarCL = cl
+	limiterExpvarMu.Unlock()
+
+	limiterExpvarOnce.Do(func() {
+		m := expvar.NewMap("iptv_proxy.limiter")
+		publish := func(name string, f func(LimiterSnapshot) int64) {
+			m.Set(name, expvar.Func(func() interface{} {
+				return f(currentLimiterSnapshot())
+			}))
+		}
+		publish("connections_accepted", func(s LimiterSnapshot) int64 { return s.ConnectionsAccepted })
+		publish("connections_rejected_limit", func(s LimiterSnapshot) int64 { return s.ConnectionsRejectedLimit })
+		publish("connections_rejected_rate", func(s LimiterSnapshot) int64 { return s.ConnectionsRejectedRate })
+		publish("grace_grants", func(s LimiterSnapshot) int64 { return s.GraceGrants })
+		publish("hls_acquired", func(s LimiterSnapshot) int64 { return s.HLSAcquired })
+		publish("hls_expired_by_sweep", func(s LimiterSnapshot) int64 { return s.HLSExpiredBySweep })
+		publish("long_lived_released", func(s LimiterSnapshot) int64 { return s.LongLivedReleased })
+		publish("active_total", func(s LimiterSnapshot) int64 { return int64(s.ActiveTotal) })
+		publish("active_hls", func(s LimiterSnapshot) int64 { return int64(s.ActiveHLS) })
+		publish("active_long_lived", func(s LimiterSnapshot) int64 { return int64(s.ActiveLongLived) })
+		publish("unique_client_ips", func(s LimiterSnapshot) int64 { return int64(s.UniqueClientIPs) })
+	})
+}
+
+func currentLimiterSnapshot() LimiterSnapshot {
+	limiterExpvarMu.Lock()
+	cl := limiterExpvarCL
+	limiterExpvarMu.Unlock()
+
+	if cl == nil {
+		return LimiterSnapshot{}
+	}
+	return cl.Snapshot()
+}
@@ -0,0 +1,40 @@
+package server
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+)
+
+// NewMetricsHandler returns an http.Handler that renders cl's ConnectionLimiter
+// counters and gauges in Prometheus text exposition format. There's no
+// external prometheus client dependency here — the format is simple enough
+// to write directly.
+func NewMetricsHandler(cl *ConnectionLimiter) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		snap := cl.Snapshot()
+
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+
+		writeCounter(w, "iptv_proxy_connections_accepted_total", "Total connections accepted.", snap.ConnectionsAccepted)
+		writeCounter(w, "iptv_proxy_connections_rejected_limit_total", "Total connections rejected for being over the capacity limit.", snap.ConnectionsRejectedLimit)
+		writeCounter(w, "iptv_proxy_connections_rejected_rate_total", "Total connections rejected by the acquire rate limiter.", snap.ConnectionsRejectedRate)
+		writeCounter(w, "iptv_proxy_grace_grants_total", "Total connections admitted via the channel-switch grace period.", snap.GraceGrants)
+		writeCounter(w, "iptv_proxy_hls_acquired_total", "Total HLS connections acquired.", snap.HLSAcquired)
+		writeCounter(w, "iptv_proxy_hls_expired_by_sweep_total", "Total HLS connections expired by the background sweeper.", snap.HLSExpiredBySweep)
+		writeCounter(w, "iptv_proxy_long_lived_released_total", "Total long-lived connections explicitly released.", snap.LongLivedReleased)
+
+		writeGauge(w, "iptv_proxy_active_total", "Currently active connections.", int64(snap.ActiveTotal))
+		writeGauge(w, "iptv_proxy_active_hls", "Currently active HLS connections.", int64(snap.ActiveHLS))
+		writeGauge(w, "iptv_proxy_active_long_lived", "Currently active long-lived connections.", int64(snap.ActiveLongLived))
+		writeGauge(w, "iptv_proxy_unique_client_ips", "Distinct client IPs currently holding a connection.", int64(snap.UniqueClientIPs))
+	})
+}
+
+func writeCounter(w io.Writer, name, help string, v int64) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n%s %d\n", name, help, name, name, v)
+}
+
+func writeGauge(w io.Writer, name, help string, v int64) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n%s %d\n", name, help, name, name, v)
+}
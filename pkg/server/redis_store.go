@@ -0,0 +1,301 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// Redis key layout for redisStore. All keys are namespaced under a single
+// prefix so multiple proxy deployments can share a Redis instance.
+const (
+	redisActiveHashSuffix = ":active"   // hash: key -> JSON-encoded connEntry
+	redisLastSeenZSuffix  = ":lastseen" // sorted set: key, score = lastSeen unix nanos
+	redisSweepLockSuffix  = ":sweeplock"
+
+	// redisSweepLockTTL bounds how long a sweeper instance holds the
+	// distributed lock before it's assumed dead and another replica may take
+	// over. The lock is taken (SET NX) before each sweep and deleted right
+	// after it; it is not held or refreshed between sweeps, so any replica
+	// may run the next one.
+	redisSweepLockTTL = 15 * time.Second
+)
+
+// admitScript atomically re-checks capacity (including the same-IP grace
+// period) and, if admitted, writes the new entry into the hash, plus the
+// lastSeen sorted set if it's an HLS entry (long-lived entries are never
+// swept by lastSeen, so they're kept out of that zset to avoid growing it
+// without bound). Running this as a single EVAL is what makes Add safe
+// under concurrent callers across replicas, the same guarantee memStore gets
+// from its mutex.
+//
+// KEYS[1] = active hash, KEYS[2] = lastseen zset
+// ARGV[1] = key, ARGV[2] = entry JSON, ARGV[3] = clientIP,
+// ARGV[4] = maxConnections (0 = unlimited), ARGV[5] = lastSeen score,
+// ARGV[6] = isHLS ("1" or "0")
+//
+// Returns {admitted (0/1), active count after the call}.
+var admitScript = redis.NewScript(`
+local active = KEYS[1]
+local lastseen = KEYS[2]
+local key = ARGV[1]
+local entry = ARGV[2]
+local clientIP = ARGV[3]
+local maxConnections = tonumber(ARGV[4])
+local score = ARGV[5]
+local isHLS = ARGV[6]
+
+local count = redis.call("HLEN", active)
+if maxConnections > 0 and count >= maxConnections then
+  local ipCount = 0
+  local all = redis.call("HVALS", active)
+  for _, v in ipairs(all) do
+    local decoded = cjson.decode(v)
+    if decoded.clientIP == clientIP then
+      ipCount = ipCount + 1
+    end
+  end
+  if not (count == maxConnections and ipCount > 0) then
+    return {0, count}
+  end
+end
+
+redis.call("HSET", active, key, entry)
+if isHLS == "1" then
+  redis.call("ZADD", lastseen, score, key)
+end
+return {1, redis.call("HLEN", active)}
+`)
+
+// redisStore is a Store backed by Redis, letting the connection budget be
+// enforced across a fleet of proxy replicas behind a load balancer instead
+// of per instance. It implements the core Store contract only: SameIPOldest
+// displacement and RegisterCancel aren't supported (see tryDisplace) since
+// picking an eviction victim by timestamp across replicas, and the cancel
+// funcs themselves, only make sense within a single process.
+type redisStore struct {
+	client         *redis.Client
+	prefix         string
+	maxConnections int // 0 = unlimited
+}
+
+// NewRedisStore returns a Store that keeps active connections in Redis under
+// keys namespaced by prefix (e.g. "iptv-proxy:limiter"), for use with
+// WithStore in multi-instance deployments. maxConnections is the proxy-wide
+// budget enforced across every replica sharing client; 0 means unlimited,
+// mirroring NewConnectionLimiter's own max parameter.
+func NewRedisStore(client *redis.Client, prefix string, maxConnections int) Store {
+	return &redisStore{client: client, prefix: prefix, maxConnections: maxConnections}
+}
+
+func (s *redisStore) activeKey() string    { return s.prefix + redisActiveHashSuffix }
+func (s *redisStore) lastSeenKey() string  { return s.prefix + redisLastSeenZSuffix }
+func (s *redisStore) sweepLockKey() string { return s.prefix + redisSweepLockSuffix }
+
+// wireEntry mirrors connEntry with exported fields, since connEntry's
+// fields are unexported (it never needed to cross a process boundary before
+// redisStore existed).
+type wireEntry struct {
+	StartTime time.Time `json:"startTime"`
+	LastSeen  time.Time `json:"lastSeen"`
+	IsHLS     bool      `json:"isHLS"`
+	ClientIP  string    `json:"clientIP"`
+	StreamID  string    `json:"streamID"`
+}
+
+func toWireEntry(e *connEntry) wireEntry {
+	return wireEntry{StartTime: e.startTime, LastSeen: e.lastSeen, IsHLS: e.isHLS, ClientIP: e.clientIP, StreamID: e.streamID}
+}
+
+func (w wireEntry) toConnEntry() *connEntry {
+	return &connEntry{startTime: w.StartTime, lastSeen: w.LastSeen, isHLS: w.IsHLS, clientIP: w.ClientIP, streamID: w.StreamID}
+}
+
+func (s *redisStore) Add(key string, entry *connEntry) (bool, int, error) {
+	ctx := context.Background()
+	payload, err := json.Marshal(toWireEntry(entry))
+	if err != nil {
+		return false, 0, fmt.Errorf("marshal entry: %w", err)
+	}
+
+	isHLS := "0"
+	if entry.isHLS {
+		isHLS = "1"
+	}
+	res, err := admitScript.Run(ctx, s.client, []string{s.activeKey(), s.lastSeenKey()},
+		key, payload, entry.clientIP, s.maxConnections, entry.lastSeen.UnixNano(), isHLS).Slice()
+	if err != nil {
+		return false, 0, err
+	}
+	admitted, _ := res[0].(int64)
+	active, _ := res[1].(int64)
+	return admitted == 1, int(active), nil
+}
+
+func (s *redisStore) Get(key string) (*connEntry, bool, error) {
+	ctx := context.Background()
+	raw, err := s.client.HGet(ctx, s.activeKey(), key).Result()
+	if err == redis.Nil {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	var w wireEntry
+	if err := json.Unmarshal([]byte(raw), &w); err != nil {
+		return nil, false, fmt.Errorf("unmarshal entry: %w", err)
+	}
+	return w.toConnEntry(), true, nil
+}
+
+func (s *redisStore) Refresh(key string) error {
+	ctx := context.Background()
+	entry, exists, err := s.Get(key)
+	if err != nil || !exists {
+		return err
+	}
+	entry.lastSeen = time.Now()
+	payload, err := json.Marshal(toWireEntry(entry))
+	if err != nil {
+		return fmt.Errorf("marshal entry: %w", err)
+	}
+	pipe := s.client.TxPipeline()
+	pipe.HSet(ctx, s.activeKey(), key, payload)
+	if entry.isHLS {
+		pipe.ZAdd(ctx, s.lastSeenKey(), redis.Z{Score: float64(entry.lastSeen.UnixNano()), Member: key})
+	}
+	_, err = pipe.Exec(ctx)
+	return err
+}
+
+func (s *redisStore) Remove(key string) error {
+	ctx := context.Background()
+	pipe := s.client.TxPipeline()
+	pipe.HDel(ctx, s.activeKey(), key)
+	pipe.ZRem(ctx, s.lastSeenKey(), key)
+	_, err := pipe.Exec(ctx)
+	return err
+}
+
+// popScript atomically reads and deletes an entry in one round trip, so
+// Pop's callers (Release, Kick) get the same check-then-remove atomicity a
+// single HGET+HDEL under a local mutex would give memStore, without a
+// separate Get that could race another Pop for the same key.
+//
+// KEYS[1] = active hash, KEYS[2] = lastseen zset, ARGV[1] = key
+//
+// Returns the removed entry's JSON, or false if key wasn't present.
+var popScript = redis.NewScript(`
+local v = redis.call("HGET", KEYS[1], ARGV[1])
+if not v then
+  return false
+end
+redis.call("HDEL", KEYS[1], ARGV[1])
+redis.call("ZREM", KEYS[2], ARGV[1])
+return v
+`)
+
+func (s *redisStore) Pop(key string) (*connEntry, bool, error) {
+	ctx := context.Background()
+	res, err := popScript.Run(ctx, s.client, []string{s.activeKey(), s.lastSeenKey()}, key).Result()
+	if err == redis.Nil {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	raw, _ := res.(string)
+	var w wireEntry
+	if err := json.Unmarshal([]byte(raw), &w); err != nil {
+		return nil, false, fmt.Errorf("unmarshal entry: %w", err)
+	}
+	return w.toConnEntry(), true, nil
+}
+
+func (s *redisStore) Count() (int, error) {
+	ctx := context.Background()
+	n, err := s.client.HLen(ctx, s.activeKey()).Result()
+	return int(n), err
+}
+
+func (s *redisStore) CountByIP(clientIP string) (int, error) {
+	entries, err := s.All()
+	if err != nil {
+		return 0, err
+	}
+	count := 0
+	for _, entry := range entries {
+		if entry.clientIP == clientIP {
+			count++
+		}
+	}
+	return count, nil
+}
+
+func (s *redisStore) All() ([]*connEntry, error) {
+	ctx := context.Background()
+	raw, err := s.client.HGetAll(ctx, s.activeKey()).Result()
+	if err != nil {
+		return nil, err
+	}
+	entries := make([]*connEntry, 0, len(raw))
+	for _, v := range raw {
+		var w wireEntry
+		if err := json.Unmarshal([]byte(v), &w); err != nil {
+			return nil, fmt.Errorf("unmarshal entry: %w", err)
+		}
+		entries = append(entries, w.toConnEntry())
+	}
+	return entries, nil
+}
+
+// SweepHLS removes and returns every HLS entry with a lastSeen older than
+// olderThan. The lastSeen sorted set lets this find candidates in
+// O(log n + k) rather than scanning the whole hash.
+func (s *redisStore) SweepHLS(olderThan time.Time) ([]*connEntry, error) {
+	ctx := context.Background()
+	keys, err := s.client.ZRangeByScore(ctx, s.lastSeenKey(), &redis.ZRangeBy{
+		Min: "-inf",
+		Max: fmt.Sprintf("%d", olderThan.UnixNano()),
+	}).Result()
+	if err != nil {
+		return nil, err
+	}
+	if len(keys) == 0 {
+		return nil, nil
+	}
+
+	var expired []*connEntry
+	for _, key := range keys {
+		entry, exists, err := s.Get(key)
+		if err != nil {
+			return expired, err
+		}
+		if !exists || !entry.isHLS {
+			continue
+		}
+		if err := s.Remove(key); err != nil {
+			return expired, err
+		}
+		expired = append(expired, entry)
+	}
+	return expired, nil
+}
+
+// TryLockSweep attempts to acquire the distributed sweep lock, so exactly
+// one replica runs the periodic HLS sweep at a time. It satisfies the
+// sweepLocker interface that sweepStaleHLS type-asserts for.
+func (s *redisStore) TryLockSweep() (bool, error) {
+	ctx := context.Background()
+	ok, err := s.client.SetNX(ctx, s.sweepLockKey(), "1", redisSweepLockTTL).Result()
+	return ok, err
+}
+
+// UnlockSweep releases the distributed sweep lock.
+func (s *redisStore) UnlockSweep() {
+	ctx := context.Background()
+	s.client.Del(ctx, s.sweepLockKey())
+}
@@ -0,0 +1,221 @@
+package server
+
+import (
+	"sync"
+	"time"
+)
+
+// Store is the backend ConnectionLimiter uses to admit, track, and expire
+// active connections. memStore (the default) keeps everything
+// process-local; redisStore shares state across replicas behind a load
+// balancer so the upstream connection budget is enforced proxy-wide rather
+// than per instance. Every method must be safe for concurrent use.
+type Store interface {
+	// Add admits entry under key — checking the connection budget (max
+	// connections, plus the single-extra grace period for an IP that
+	// already holds a slot) and inserting it — atomically, so two
+	// concurrent Add calls can never both observe room for the last slot.
+	// ok reports whether entry was admitted; active is the resulting total
+	// active count, which callers use to tell a grace-period admission
+	// (active > maxConnections) from an ordinary one.
+	Add(key string, entry *connEntry) (ok bool, active int, err error)
+
+	// Get returns the entry stored under key, if any.
+	Get(key string) (entry *connEntry, exists bool, err error)
+
+	// Refresh updates the lastSeen timestamp for an already-admitted key.
+	// It is a no-op if key isn't present.
+	Refresh(key string) error
+
+	// Remove deletes key, if present.
+	Remove(key string) error
+
+	// Pop atomically removes and returns the entry stored under key, if
+	// any — the delete-side counterpart to Add's atomic admit. Release and
+	// Kick use it instead of a separate Get-then-Remove, so two concurrent
+	// calls for the same key still can't both observe it as present, without
+	// the caller having to hold a lock across what may be a network round
+	// trip to the store.
+	Pop(key string) (entry *connEntry, existed bool, err error)
+
+	// Count returns the total number of active entries.
+	Count() (int, error)
+
+	// CountByIP returns the number of active entries for clientIP.
+	CountByIP(clientIP string) (int, error)
+
+	// All returns every active entry, for the admin/metrics gauges that
+	// need to break the total down (by HLS vs. long-lived, by client IP).
+	// It is not on any hot path, so backends are free to implement it with
+	// a bulk read.
+	All() ([]*connEntry, error)
+
+	// SweepHLS removes and returns every HLS entry whose lastSeen is older
+	// than olderThan. Callers that need the key can derive it from the
+	// entry's clientIP/streamID via connKey; returning the entry itself
+	// (rather than just the key) lets callers guard any per-key bookkeeping
+	// they keep outside the store (e.g. cl.cancels) against the key having
+	// already been reused by a fresher entry.
+	SweepHLS(olderThan time.Time) ([]*connEntry, error)
+}
+
+// memStore is the default, process-local Store implementation. It's also
+// what gives SameIPOldest displacement and RegisterCancel their full view
+// of active entries — capabilities a distributed Store can't offer, since
+// ordering by timestamp across replicas and the cancel funcs themselves
+// only make sense within one process. See tryDisplace.
+type memStore struct {
+	mu             sync.Mutex
+	active         map[string]*connEntry
+	maxConnections int // 0 = unlimited
+
+	// graceDisabled suppresses the same-IP grace carve-out below, so that at
+	// capacity Add simply fails instead of silently admitting a grace entry.
+	// ConnectionLimiter sets this when it's configured with a
+	// DisplacementPolicy, so tryDisplace (not grace) is what decides whether
+	// a same-IP caller gets the extra slot.
+	graceDisabled bool
+}
+
+func newMemStore(maxConnections int) *memStore {
+	return &memStore{
+		active:         make(map[string]*connEntry),
+		maxConnections: maxConnections,
+	}
+}
+
+func (s *memStore) Add(key string, entry *connEntry) (bool, int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.maxConnections > 0 && len(s.active) >= s.maxConnections {
+		// Grace period: allow exactly one extra connection for an IP that
+		// already has an active stream, so a channel switch isn't rejected
+		// just because the old stream hasn't disconnected yet. Only applies
+		// if total active is exactly at the limit, not already over it from
+		// a previous grace, and only when a displacement policy isn't
+		// already the mechanism handling this case.
+		if s.graceDisabled || !(len(s.active) == s.maxConnections && s.countByIPLocked(entry.clientIP) > 0) {
+			return false, len(s.active), nil
+		}
+	}
+	s.active[key] = entry
+	return true, len(s.active), nil
+}
+
+func (s *memStore) Get(key string) (*connEntry, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	entry, exists := s.active[key]
+	return entry, exists, nil
+}
+
+func (s *memStore) Refresh(key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if entry, exists := s.active[key]; exists {
+		entry.lastSeen = time.Now()
+	}
+	return nil
+}
+
+func (s *memStore) Remove(key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.active, key)
+	return nil
+}
+
+func (s *memStore) Pop(key string) (*connEntry, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	entry, exists := s.active[key]
+	if exists {
+		delete(s.active, key)
+	}
+	return entry, exists, nil
+}
+
+func (s *memStore) Count() (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.active), nil
+}
+
+func (s *memStore) CountByIP(clientIP string) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.countByIPLocked(clientIP), nil
+}
+
+// countByIPLocked must be called with s.mu held.
+func (s *memStore) countByIPLocked(clientIP string) int {
+	count := 0
+	for _, entry := range s.active {
+		if entry.clientIP == clientIP {
+			count++
+		}
+	}
+	return count
+}
+
+func (s *memStore) All() ([]*connEntry, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	entries := make([]*connEntry, 0, len(s.active))
+	for _, entry := range s.active {
+		// Copy rather than hand back the live pointer: Refresh mutates
+		// entry.lastSeen in place under s.mu, and callers (admin/metrics
+		// gauges) read these fields after this lock is released.
+		e := *entry
+		entries = append(entries, &e)
+	}
+	return entries, nil
+}
+
+func (s *memStore) SweepHLS(olderThan time.Time) ([]*connEntry, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var expired []*connEntry
+	for key, entry := range s.active {
+		if entry.isHLS && entry.lastSeen.Before(olderThan) {
+			delete(s.active, key)
+			expired = append(expired, entry)
+		}
+	}
+	return expired, nil
+}
+
+// evictOldestForIP removes and returns the key and entry of the oldest entry
+// (by startTime, or lastSeen for HLS) belonging to clientIP, for the
+// SameIPOldest displacement policy. This is a memStore-only capability:
+// displacement needs to pick and remove the oldest entry in one step, which
+// the generic Store interface has no operation for. The caller (tryDisplace)
+// uses the returned entry's startTime to guard its own cancels cleanup
+// against a cancel re-registered for the same key after the evict.
+func (s *memStore) evictOldestForIP(clientIP string) (string, *connEntry, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var oldestKey string
+	var oldestEntry *connEntry
+	var oldestTime time.Time
+	found := false
+	for key, entry := range s.active {
+		if entry.clientIP != clientIP {
+			continue
+		}
+		ts := entry.startTime
+		if entry.isHLS {
+			ts = entry.lastSeen
+		}
+		if !found || ts.Before(oldestTime) {
+			oldestKey, oldestEntry, oldestTime, found = key, entry, ts, true
+		}
+	}
+	if found {
+		delete(s.active, oldestKey)
+	}
+	return oldestKey, oldestEntry, found
+}